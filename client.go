@@ -7,6 +7,7 @@ package dns
 // A client implementation.
 
 import (
+	"crypto/tls"
 	"io"
 	"net"
 	"time"
@@ -14,6 +15,10 @@ import (
 
 const dnsTimeout time.Duration = 2 * 1e9
 
+// DefaultTLSPort is the conventional port for DNS-over-TLS (RFC 7858), used
+// by servers such as 1.1.1.1 and 9.9.9.9.
+const DefaultTLSPort = "853"
+
 // A Conn represents a connection to a DNS server.
 type Conn struct {
 	net.Conn                         // a net.Conn holding the connection
@@ -26,13 +31,16 @@ type Conn struct {
 
 // A Client defines parameters for a DNS client. A nil Client is usable for sending queries.
 type Client struct {
-	Net            string            // if "tcp" a TCP query will be initiated, otherwise an UDP one (default is "" for UDP)
-	DialTimeout    time.Duration     // net.DialTimeout (ns), defaults to 2 * 1e9
-	ReadTimeout    time.Duration     // net.Conn.SetReadTimeout value for connections (ns), defaults to 2 * 1e9
-	WriteTimeout   time.Duration     // net.Conn.SetWriteTimeout value for connections (ns), defaults to 2 * 1e9
-	TsigSecret     map[string]string // secret(s) for Tsig map[<zonename>]<base64 secret>, zonename must be fully qualified
-	SingleInflight bool              // if true suppress multiple outstanding queries for the same Qname, Qtype and Qclass
-	group          singleflight
+	Net              string            // if "tcp" a TCP query will be initiated, if "tcp-tls" a DNS-over-TLS query, otherwise an UDP one (default is "" for UDP)
+	DialTimeout      time.Duration     // net.DialTimeout (ns), defaults to 2 * 1e9
+	ReadTimeout      time.Duration     // net.Conn.SetReadTimeout value for connections (ns), defaults to 2 * 1e9
+	WriteTimeout     time.Duration     // net.Conn.SetWriteTimeout value for connections (ns), defaults to 2 * 1e9
+	TsigSecret       map[string]string // secret(s) for Tsig map[<zonename>]<base64 secret>, zonename must be fully qualified
+	SingleInflight   bool              // if true suppress multiple outstanding queries for the same Qname, Qtype and Qclass
+	Pool             *Pool             // if non-nil, used to reuse persistent connections for "tcp" and "tcp-tls" exchanges
+	TLSConfig        *tls.Config       // TLS configuration used when Net is "tcp-tls"; a nil value uses the zero tls.Config
+	RetryOnTruncated bool              // if true, a truncated UDP reply is automatically retried with a larger EDNS0 size and, failing that, over TCP
+	group            singleflight
 }
 
 // Exchange performs a synchronous UDP query. It sends the message m to the address
@@ -62,7 +70,8 @@ func Exchange(m *Msg, a string) (r *Msg, err error) {
 //
 func (c *Client) Exchange(m *Msg, a string) (r *Msg, rtt time.Duration, err error) {
 	if !c.SingleInflight {
-		return c.exchange(m, a)
+		r, rtt, err = c.exchange(m, a)
+		return c.retryTruncated(m, a, r, rtt, err)
 	}
 	// This adds a bunch of garbage, TODO(miek).
 	t := "nop"
@@ -83,22 +92,90 @@ func (c *Client) Exchange(m *Msg, a string) (r *Msg, rtt time.Duration, err erro
 		r1 := r.copy()
 		r = r1
 	}
-	return r, rtt, nil
+	return c.retryTruncated(m, a, r, rtt, nil)
+}
+
+// maxUDPSize is the EDNS0 UDP payload size Client advertises when
+// nudging a server for a larger answer before giving up on UDP
+// altogether, per Client.RetryOnTruncated.
+const maxUDPSize = 4096
+
+// retryTruncated backs Client.RetryOnTruncated: when r was received
+// over UDP with the TC bit set, it first retries over UDP with a
+// larger EDNS0 buffer size advertised, and only falls back to TCP if
+// the answer still doesn't fit. The extra round trip(s) are folded
+// into the rtt handed back to the caller.
+func (c *Client) retryTruncated(m *Msg, a string, r *Msg, rtt time.Duration, err error) (*Msg, time.Duration, error) {
+	if err != nil || r == nil || !r.Truncated || !c.RetryOnTruncated || (c.Net != "" && c.Net != "udp") {
+		return r, rtt, err
+	}
+	if opt := m.IsEdns0(); opt == nil || opt.UDPSize() < maxUDPSize {
+		m2 := m.copy()
+		if opt2 := m2.IsEdns0(); opt2 != nil {
+			opt2.SetUDPSize(maxUDPSize)
+		} else {
+			m2.SetEdns0(maxUDPSize, false)
+		}
+		if r2, rtt2, err2 := c.exchange(m2, a); err2 == nil && r2 != nil {
+			rtt += rtt2
+			r = r2
+			if !r.Truncated {
+				return r, rtt, nil
+			}
+		}
+	}
+	r2, rtt2, err2 := c.exchangeNet(m, a, "tcp")
+	rtt += rtt2
+	if err2 != nil {
+		return r, rtt, err2
+	}
+	return r2, rtt, nil
 }
 
 func (c *Client) exchange(m *Msg, a string) (r *Msg, rtt time.Duration, err error) {
-	co := new(Conn)
+	return c.exchangeNet(m, a, c.Net)
+}
+
+// exchangeNet is exchange with the network explicitly overridable,
+// letting callers such as retryTruncated force "tcp" for one exchange
+// without copying *c (Client embeds a singleflight group, which must
+// never be copied by value).
+func (c *Client) exchangeNet(m *Msg, a, network string) (r *Msg, rtt time.Duration, err error) {
+	if c.Pool != nil && (network == "tcp" || network == "tcp-tls") {
+		return c.Pool.exchange(c, m, a, network)
+	}
+	co, err := c.dialConn(a, network)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer co.Close()
+	opt := m.IsEdns0()
+	if opt != nil && opt.UDPSize() >= MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	if err = co.WriteMsg(m); err != nil {
+		return nil, 0, err
+	}
+	r, err = co.ReadMsg()
+	return r, co.rtt, err
+}
+
+// dialConn dials a over network and returns a *Conn configured with c's
+// timeouts and Tsig secret, ready for WriteMsg/ReadMsg. The caller owns
+// the connection and is responsible for closing it.
+func (c *Client) dialConn(a, network string) (co *Conn, err error) {
+	co = new(Conn)
 	timeout := dnsTimeout
 	if c.DialTimeout != 0 {
 		timeout = c.DialTimeout
 	}
-	if c.Net == "" {
-		co.Conn, err = net.DialTimeout("udp", a, timeout)
+	if network == "" {
+		co.Conn, err = c.dialTimeout("udp", a, timeout)
 	} else {
-		co.Conn, err = net.DialTimeout(c.Net, a, timeout)
+		co.Conn, err = c.dialTimeout(network, a, timeout)
 	}
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	timeout = dnsTimeout
 	if c.ReadTimeout != 0 {
@@ -110,17 +187,29 @@ func (c *Client) exchange(m *Msg, a string) (r *Msg, rtt time.Duration, err erro
 		timeout = c.WriteTimeout
 	}
 	co.SetWriteDeadline(time.Now().Add(timeout))
-	defer co.Close()
-	opt := m.IsEdns0()
-	if opt != nil && opt.UDPSize() >= MinMsgSize {
-		co.UDPSize = opt.UDPSize()
-	}
 	co.TsigSecret = c.TsigSecret
-	if err = co.WriteMsg(m); err != nil {
-		return nil, 0, err
+	return co, nil
+}
+
+// dialTimeout dials network/address, giving Client a single place to
+// special-case how a connection is established for a given c.Net.
+func (c *Client) dialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	if network == "tcp-tls" {
+		dialer := &net.Dialer{Timeout: timeout}
+		return tls.DialWithDialer(dialer, "tcp", address, c.TLSConfig)
 	}
-	r, err = co.ReadMsg()
-	return r, co.rtt, err
+	return net.DialTimeout(network, address, timeout)
+}
+
+// isStreamConn reports whether conn is framed like TCP, i.e. needs the
+// two-byte length prefix: a plain *net.TCPConn, or a *tls.Conn (as used
+// for DNS-over-TLS) wrapping one.
+func isStreamConn(conn net.Conn) bool {
+	if _, ok := conn.(*net.TCPConn); ok {
+		return true
+	}
+	_, ok := conn.(*tls.Conn)
+	return ok
 }
 
 // ReadMsg reads a message from the connection co.
@@ -129,7 +218,7 @@ func (c *Client) exchange(m *Msg, a string) (r *Msg, rtt time.Duration, err erro
 func (co *Conn) ReadMsg() (*Msg, error) {
 	var p []byte
 	m := new(Msg)
-	if _, ok := co.Conn.(*net.TCPConn); ok {
+	if isStreamConn(co.Conn) {
 		p = make([]byte, MaxMsgSize)
 	} else {
 		if co.UDPSize >= 512 {
@@ -165,7 +254,8 @@ func (co *Conn) Read(p []byte) (n int, err error) {
 	if len(p) < 2 {
 		return 0, io.ErrShortBuffer
 	}
-	if t, ok := co.Conn.(*net.TCPConn); ok {
+	if isStreamConn(co.Conn) {
+		t := co.Conn
 		n, err = t.Read(p[0:2])
 		if err != nil || n != 2 {
 			return n, err
@@ -228,7 +318,8 @@ func (co *Conn) WriteMsg(m *Msg) (err error) {
 
 // Write implements the net.Conn Write method.
 func (co *Conn) Write(p []byte) (n int, err error) {
-	if t, ok := co.Conn.(*net.TCPConn); ok {
+	if isStreamConn(co.Conn) {
+		t := co.Conn
 		if len(p) < 2 {
 			return 0, io.ErrShortBuffer
 		}
@@ -0,0 +1,174 @@
+// Copyright 2011 Miek Gieben. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRetryOnTruncatedFallsBackToTCP checks that a truncated UDP reply
+// triggers a larger-EDNS0 UDP retry and, when that's still truncated,
+// a TCP fallback that returns the full, untruncated answer with its
+// round trips folded into the reported rtt.
+func TestRetryOnTruncatedFallsBackToTCP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer pc.Close()
+	addr := pc.LocalAddr().String()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen tcp on %s: %v", addr, err)
+	}
+	defer ln.Close()
+
+	// Every UDP query gets answered truncated, however large the
+	// advertised EDNS0 buffer is, forcing the eventual TCP fallback.
+	go func() {
+		buf := make([]byte, MaxMsgSize)
+		for {
+			n, raddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m := new(Msg)
+			if m.Unpack(buf[:n]) != nil {
+				continue
+			}
+			m.Truncated = true
+			out, _ := m.Pack()
+			pc.WriteTo(out, raddr)
+		}
+	}()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		f, err := readFramedTCP(conn)
+		if err != nil {
+			return
+		}
+		m := new(Msg)
+		if m.Unpack(f) != nil {
+			return
+		}
+		m.Truncated = false
+		writeFramedTCP(conn, mustPack(m))
+	}()
+
+	c := &Client{RetryOnTruncated: true}
+	m := new(Msg)
+	m.SetQuestion(Fqdn("truncated.example."), TypeA)
+
+	r, rtt, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if r == nil || r.Truncated {
+		t.Fatalf("expected a final, untruncated reply, got %+v", r)
+	}
+	if rtt <= 0 {
+		t.Fatalf("expected the retries' round trips to be folded into rtt, got %v", rtt)
+	}
+}
+
+// TestRetryOnTruncatedExplicitNet checks that Net: "udp" is treated the
+// same as the zero value: RetryOnTruncated still fires, since both mean
+// "use UDP" per the Net field's own doc comment. It also checks that
+// Net: "tcp" makes retryTruncated a no-op.
+func TestRetryOnTruncatedExplicitNet(t *testing.T) {
+	c := &Client{Net: "udp", RetryOnTruncated: true, ReadTimeout: 10 * time.Millisecond}
+	r := &Msg{Truncated: true}
+	if _, _, err := c.retryTruncated(new(Msg), "127.0.0.1:1", r, 0, nil); err == nil {
+		t.Fatal("expected an error from the retry's network attempts, proving retryTruncated attempted a real retry instead of no-oping")
+	}
+
+	cTCP := &Client{Net: "tcp", RetryOnTruncated: true}
+	r2 := &Msg{Truncated: true}
+	r3, rtt3, err3 := cTCP.retryTruncated(new(Msg), "127.0.0.1:1", r2, 5*time.Millisecond, nil)
+	if err3 != nil || rtt3 != 5*time.Millisecond || r3 != r2 {
+		t.Fatalf("expected retryTruncated to no-op when Net is already tcp, got r=%v rtt=%v err=%v", r3, rtt3, err3)
+	}
+}
+
+// TestExchangeTLS checks that Net: "tcp-tls" dials and handshakes over
+// TLS end to end, not just that dialTimeout/isStreamConn compile: a real
+// tls.Listen-backed server must receive a correctly framed query and
+// have its reply correctly unframed and unpacked by the client.
+func TestExchangeTLS(t *testing.T) {
+	cert := mustSelfSignedCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("tls.Listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		f, err := readFramedTCP(conn)
+		if err != nil {
+			return
+		}
+		writeFramedTCP(conn, f)
+	}()
+
+	c := &Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	m := new(Msg)
+	m.SetQuestion(Fqdn("tls.example."), TypeA)
+
+	r, _, err := c.Exchange(m, ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Exchange over tcp-tls: %v", err)
+	}
+	if r == nil || len(r.Question) == 0 || r.Question[0].Name != Fqdn("tls.example.") {
+		t.Fatalf("unexpected reply: %+v", r)
+	}
+}
+
+func mustSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func mustPack(m *Msg) []byte {
+	out, err := m.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+// Copyright 2011 Miek Gieben. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"time"
+)
+
+// A Result houses the outcome of an asynchronous exchange: the reply
+// message, the round trip time it took, and any error that occurred.
+type Result struct {
+	Msg *Msg
+	RTT time.Duration
+	Err error
+}
+
+// ExchangeAsync behaves like Exchange but does not block the caller. It
+// sends m to a and immediately returns a channel on which exactly one
+// Result is delivered once the exchange finishes, or ctx is done,
+// whichever happens first. The channel is always closed after that
+// single send, so it is safe to range over.
+//
+// When this call owns its connection outright (c.SingleInflight is
+// false and c.Pool is nil), cancelling ctx is real: the connection is
+// closed out from under the blocked read, so the goroutine and socket
+// it holds unwind immediately instead of lingering until dnsTimeout or
+// c.ReadTimeout. When c.SingleInflight or c.Pool are in play the
+// underlying exchange may be shared with other callers, so cancelling
+// ctx there only stops this caller from waiting on the outcome; it does
+// not abort the exchange itself.
+func (c *Client) ExchangeAsync(ctx context.Context, m *Msg, a string) <-chan Result {
+	out := make(chan Result, 1)
+	go func() {
+		r, rtt, err := c.exchangeAsync(ctx, m, a)
+		out <- Result{r, rtt, err}
+		close(out)
+	}()
+	return out
+}
+
+// exchangeAsync implements ExchangeAsync's two cancellation modes; see
+// its doc comment for which applies when.
+func (c *Client) exchangeAsync(ctx context.Context, m *Msg, a string) (*Msg, time.Duration, error) {
+	if c.SingleInflight || c.Pool != nil {
+		done := make(chan Result, 1)
+		go func() {
+			r, rtt, err := c.Exchange(m, a)
+			done <- Result{r, rtt, err}
+		}()
+		select {
+		case res := <-done:
+			return res.Msg, res.RTT, res.Err
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	co, err := c.dialConn(a, c.Net)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer co.Close()
+
+	// Closing co unblocks whichever of WriteMsg/ReadMsg below is in
+	// flight, so ctx cancellation actually tears down the connection
+	// rather than merely giving up on waiting for it.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			co.Close()
+		case <-stop:
+		}
+	}()
+
+	opt := m.IsEdns0()
+	if opt != nil && opt.UDPSize() >= MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	if err := co.WriteMsg(m); err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, err
+	}
+	r, err := co.ReadMsg()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, err
+	}
+	return c.retryTruncated(m, a, r, co.rtt, nil)
+}
@@ -0,0 +1,69 @@
+// Copyright 2011 Miek Gieben. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestExchangeAsyncContextCancellation checks that cancelling ctx on a
+// private (non-pooled, non-SingleInflight) ExchangeAsync call both
+// returns promptly and tears down the underlying connection, instead of
+// leaving it to linger until dnsTimeout.
+func TestExchangeAsyncContextCancellation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+		// Deliberately never reply.
+	}()
+
+	c := &Client{Net: "tcp"}
+	m := new(Msg)
+	m.SetQuestion(Fqdn("slow.example."), TypeA)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resCh := c.ExchangeAsync(ctx, m, ln.Addr().String())
+
+	var srvConn net.Conn
+	select {
+	case srvConn = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("server never saw a connection")
+	}
+	if _, err := readFramedTCP(srvConn); err != nil {
+		t.Fatalf("server failed to read the query: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case res := <-resCh:
+		if res.Err == nil {
+			t.Fatal("expected a cancellation error after ctx was cancelled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ExchangeAsync did not return promptly after ctx was cancelled")
+	}
+
+	srvConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1)
+	if _, err := srvConn.Read(buf); err == nil {
+		t.Fatal("expected the client to have closed its end of the connection on cancel")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2011 Miek Gieben. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoServers is returned by ExchangeAny and ExchangeFallback when no
+// servers were given to query.
+var ErrNoServers = errors.New("dns: no servers to query")
+
+// ExchangeAny sends m to every address in servers concurrently and
+// returns the first reply that comes back without a transport error and
+// without Rcode RcodeServerFailure, together with the address that
+// produced it. Once a winner is found the still-running exchanges are
+// abandoned by closing their connections. If every server fails,
+// ExchangeAny returns the last error seen (or the last, still-failing
+// reply if every server answered but none succeeded).
+func (c *Client) ExchangeAny(m *Msg, servers []string) (r *Msg, server string, rtt time.Duration, err error) {
+	if len(servers) == 0 {
+		return nil, "", 0, ErrNoServers
+	}
+
+	type raceResult struct {
+		idx int
+		r   *Msg
+		rtt time.Duration
+		err error
+	}
+
+	results := make(chan raceResult, len(servers))
+	conns := make([]*Conn, len(servers))
+	var mu sync.Mutex
+	decided := false // set once a winner is found; guarded by mu
+
+	for i, a := range servers {
+		i, a := i, a
+		go func() {
+			co, err := c.dialConn(a, c.Net)
+			if err != nil {
+				results <- raceResult{idx: i, err: err}
+				return
+			}
+			mu.Lock()
+			if decided {
+				mu.Unlock()
+				co.Close()
+				return
+			}
+			conns[i] = co
+			mu.Unlock()
+
+			if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= MinMsgSize {
+				co.UDPSize = opt.UDPSize()
+			}
+
+			start := time.Now()
+			if err := co.WriteMsg(m); err != nil {
+				results <- raceResult{idx: i, err: err}
+				return
+			}
+			reply, err := co.ReadMsg()
+			results <- raceResult{idx: i, r: reply, rtt: time.Since(start), err: err}
+		}()
+	}
+
+	closeOthers := func(winner int) {
+		mu.Lock()
+		defer mu.Unlock()
+		decided = true
+		for i, co := range conns {
+			if i != winner && co != nil {
+				co.Close()
+			}
+		}
+	}
+
+	for i := 0; i < len(servers); i++ {
+		res := <-results
+		mu.Lock()
+		if co := conns[res.idx]; co != nil {
+			co.Close()
+		}
+		mu.Unlock()
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		if res.r.Rcode == RcodeServerFailure {
+			r, server, rtt = res.r, servers[res.idx], res.rtt
+			continue
+		}
+		closeOthers(res.idx)
+		return res.r, servers[res.idx], res.rtt, nil
+	}
+	return r, server, rtt, err
+}
+
+// ExchangeFallback tries each address in servers in turn, sending m and
+// waiting up to timeout for a reply. It moves on to the next server on
+// any error, on timeout, or on an RcodeServerFailure reply, returning
+// the first other reply it gets along with the server that produced it.
+// If every server fails, it returns the last error seen (or the last
+// still-failing reply if every server answered but none succeeded).
+func (c *Client) ExchangeFallback(m *Msg, servers []string, timeout time.Duration) (r *Msg, server string, rtt time.Duration, err error) {
+	if len(servers) == 0 {
+		return nil, "", 0, ErrNoServers
+	}
+	// A fresh *Client is built field-by-field rather than via "fc := *c"
+	// so as not to copy c's embedded singleflight group, which holds a
+	// mutex and so must never be copied by value.
+	fc := &Client{
+		Net:              c.Net,
+		TsigSecret:       c.TsigSecret,
+		SingleInflight:   c.SingleInflight,
+		Pool:             c.Pool,
+		TLSConfig:        c.TLSConfig,
+		RetryOnTruncated: c.RetryOnTruncated,
+		DialTimeout:      timeout,
+		ReadTimeout:      timeout,
+		WriteTimeout:     timeout,
+	}
+
+	for _, a := range servers {
+		reply, d, e := fc.Exchange(m, a)
+		if e != nil {
+			err = e
+			continue
+		}
+		if reply.Rcode == RcodeServerFailure {
+			r, server, rtt = reply, a, d
+			continue
+		}
+		return reply, a, d, nil
+	}
+	return r, server, rtt, err
+}
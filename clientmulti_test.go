@@ -0,0 +1,157 @@
+// Copyright 2011 Miek Gieben. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestExchangeFallbackSkipsFailingServer checks that ExchangeFallback
+// moves on to the next server when the first one refuses the
+// connection, running end to end the fresh Client it builds for the
+// given timeout instead of a "*c" copy of Client's singleflight group
+// (which go vet catches statically).
+func TestExchangeFallbackSkipsFailingServer(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close() // nothing listens here anymore; dialing it should fail
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		f, err := readFramedTCP(conn)
+		if err != nil {
+			return
+		}
+		writeFramedTCP(conn, f)
+	}()
+
+	c := &Client{Net: "tcp"}
+	m := new(Msg)
+	m.SetQuestion(Fqdn("fallback.example."), TypeA)
+
+	r, server, _, err := c.ExchangeFallback(m, []string{deadAddr, ln.Addr().String()}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ExchangeFallback: %v", err)
+	}
+	if server != ln.Addr().String() {
+		t.Fatalf("expected the second server to answer, got %q", server)
+	}
+	if r == nil {
+		t.Fatal("expected a reply")
+	}
+}
+
+// TestExchangeAnyReturnsWinnerAndClosesLosers checks that ExchangeAny
+// returns the fastest non-SERVFAIL reply while a slow, still in-flight
+// loser gets its connection closed by closeOthers rather than being
+// left to answer (or leak) after the race is already decided, and that
+// an immediate SERVFAIL reply is tracked as a fallback rather than
+// returned outright.
+func TestExchangeAnyReturnsWinnerAndClosesLosers(t *testing.T) {
+	winner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer winner.Close()
+	go func() {
+		conn, err := winner.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		f, err := readFramedTCP(conn)
+		if err != nil {
+			return
+		}
+		writeFramedTCP(conn, f) // Rcode 0: the winning reply
+	}()
+
+	servfail, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer servfail.Close()
+	go func() {
+		conn, err := servfail.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		f, err := readFramedTCP(conn)
+		if err != nil {
+			return
+		}
+		m := new(Msg)
+		if m.Unpack(f) != nil {
+			return
+		}
+		m.Rcode = RcodeServerFailure
+		writeFramedTCP(conn, mustPack(m))
+	}()
+
+	slow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer slow.Close()
+	slowClosed := make(chan error, 1)
+	go func() {
+		conn, err := slow.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := readFramedTCP(conn); err != nil {
+			slowClosed <- err
+			return
+		}
+		// Long enough that the race is already decided by the time
+		// this checks whether it was closed out from under it.
+		time.Sleep(300 * time.Millisecond)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 1)
+		_, err = conn.Read(buf)
+		slowClosed <- err
+	}()
+
+	c := &Client{Net: "tcp"}
+	m := new(Msg)
+	m.SetQuestion(Fqdn("race.example."), TypeA)
+
+	servers := []string{slow.Addr().String(), servfail.Addr().String(), winner.Addr().String()}
+	r, server, _, err := c.ExchangeAny(m, servers)
+	if err != nil {
+		t.Fatalf("ExchangeAny: %v", err)
+	}
+	if server != winner.Addr().String() {
+		t.Fatalf("expected the fast winner to answer, got %q", server)
+	}
+	if r == nil || r.Rcode == RcodeServerFailure {
+		t.Fatalf("expected the winning, non-SERVFAIL reply, got %+v", r)
+	}
+
+	select {
+	case err := <-slowClosed:
+		if err == nil {
+			t.Fatal("expected the slow loser's connection to have been closed by closeOthers")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("slow server never observed its connection being closed")
+	}
+}
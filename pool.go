@@ -0,0 +1,402 @@
+// Copyright 2011 Miek Gieben. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default tuning parameters for a *Pool, used whenever the matching
+// field is left at its zero value.
+const (
+	defaultMaxIdleConns    = 2
+	defaultMaxConnsPerHost = 4
+	defaultIdleTimeout     = 30 * time.Second
+)
+
+// A Pool maintains a bounded set of persistent connections to DNS
+// servers, for use by Client.Exchange when c.Net is "tcp" or
+// "tcp-tls". Connections are kept per network+address and pipelined
+// per RFC 7766: many callers may have queries outstanding on the same
+// underlying connection at once, matched to their replies by DNS
+// message ID. This avoids paying a fresh TCP (and, for "tcp-tls", TLS)
+// handshake for every query.
+//
+// The zero value is ready to use; NewPool returns an equivalent *Pool.
+type Pool struct {
+	// MaxIdleConns caps how many unused connections per
+	// network+address are kept warm rather than closed outright.
+	// 0 means defaultMaxIdleConns.
+	MaxIdleConns int
+	// MaxConnsPerHost is compared against the number of connections a
+	// network+address holds when a new one is dialed for it. A new
+	// connection is dialed only when the host holds none, so the check
+	// always passes and does not bound callers that dial at the same
+	// moment. 0 means defaultMaxConnsPerHost.
+	MaxConnsPerHost int
+	// IdleTimeout is how long a connection may sit unused before
+	// it is closed and evicted from the pool. 0 means
+	// defaultIdleTimeout; a negative value disables the timeout.
+	IdleTimeout time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*poolHost
+}
+
+// NewPool returns an empty, ready to use *Pool.
+func NewPool() *Pool { return &Pool{hosts: make(map[string]*poolHost)} }
+
+func (p *Pool) maxIdleConns() int {
+	if p.MaxIdleConns > 0 {
+		return p.MaxIdleConns
+	}
+	return defaultMaxIdleConns
+}
+
+func (p *Pool) maxConnsPerHost() int {
+	if p.MaxConnsPerHost > 0 {
+		return p.MaxConnsPerHost
+	}
+	return defaultMaxConnsPerHost
+}
+
+func (p *Pool) idleTimeout() time.Duration {
+	switch {
+	case p.IdleTimeout > 0:
+		return p.IdleTimeout
+	case p.IdleTimeout < 0:
+		return 0
+	default:
+		return defaultIdleTimeout
+	}
+}
+
+// poolHost holds the live, pipelined connections for one network+address pair.
+type poolHost struct {
+	mu    sync.Mutex
+	conns []*poolConn
+	next  int // round-robin cursor into conns
+}
+
+func (h *poolHost) remove(pc *poolConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, c := range h.conns {
+		if c == pc {
+			h.conns = append(h.conns[:i], h.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// pendingResult is handed to whichever goroutine is waiting on a given
+// DNS message ID once its reply (or a fatal read error) arrives.
+type pendingResult struct {
+	m   *Msg
+	err error
+}
+
+// poolConn is a single pooled connection shared by any number of
+// concurrent callers; each query is matched to its reply by DNS
+// message ID so requests can be pipelined on the wire.
+type poolConn struct {
+	*Conn
+	host *poolHost
+
+	wmu sync.Mutex // serializes writes on the wire
+
+	mu      sync.Mutex
+	pending map[uint16]chan pendingResult
+	nextID  uint16 // cursor used to pick a wire ID clear of any collision
+	used    time.Time
+	dead    error // non-nil once the read loop has given up on this conn
+}
+
+func newPoolConn(h *poolHost, co *Conn) *poolConn {
+	pc := &poolConn{
+		Conn:    co,
+		host:    h,
+		pending: make(map[uint16]chan pendingResult),
+		used:    time.Now(),
+	}
+	go pc.readLoop()
+	return pc
+}
+
+// readLoop continuously reads replies off the wire and dispatches each
+// to the caller waiting on its message ID, until the connection fails.
+func (pc *poolConn) readLoop() {
+	for {
+		r, err := pc.ReadMsg()
+		if err != nil {
+			pc.abort(err)
+			return
+		}
+		pc.mu.Lock()
+		ch, ok := pc.pending[r.Id]
+		if ok {
+			delete(pc.pending, r.Id)
+		}
+		pc.mu.Unlock()
+		if ok {
+			ch <- pendingResult{m: r}
+		}
+	}
+}
+
+// abort marks pc as dead, fails every caller still waiting on a reply,
+// closes the underlying connection and drops pc from its host.
+func (pc *poolConn) abort(err error) {
+	pc.mu.Lock()
+	if pc.dead != nil {
+		pc.mu.Unlock()
+		return
+	}
+	pc.dead = err
+	pending := pc.pending
+	pc.pending = nil
+	pc.mu.Unlock()
+
+	for _, ch := range pending {
+		ch <- pendingResult{err: err}
+	}
+	pc.Close()
+	pc.host.remove(pc)
+}
+
+func (pc *poolConn) isAlive() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.dead == nil
+}
+
+func (pc *poolConn) lastUsed() time.Time {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.used
+}
+
+// idle reports whether pc has no queries currently outstanding, and so
+// is a safe candidate for eviction under MaxIdleConns.
+func (pc *poolConn) idle() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending) == 0
+}
+
+// errPoolReadTimeout is returned by poolConn.exchange when a reply
+// doesn't arrive within the caller's own read timeout. It never tears
+// down pc: the connection is shared with other pipelined callers who
+// may still be within their own budget, so a late reply (should it
+// still arrive) is simply dropped by readLoop finding no pending entry.
+var errPoolReadTimeout = errors.New("dns: timeout waiting for reply on a pooled connection")
+
+// exchange sends m on pc on behalf of c and waits for its matching
+// reply, bounding the wait by c's read/write timeouts. It does not call
+// SetReadDeadline on the shared connection: pc's single readLoop
+// goroutine serves every pipelined caller out of one blocked ReadMsg
+// call, so a deadline set there would apply to all of them at once,
+// letting one caller's timeout spuriously fail or extend everyone
+// else's in-flight exchange. Instead each caller races its own
+// pendingResult channel against a private timer and, on timeout, simply
+// withdraws its own entry from pc.pending. If m's ID collides with one
+// already outstanding on pc, the query is sent with a different wire ID
+// and the reply is translated back to m's ID before it is returned, so
+// pipelined callers can never steal each other's replies.
+func (pc *poolConn) exchange(c *Client, m *Msg) (*Msg, time.Duration, error) {
+	ch := make(chan pendingResult, 1)
+	pc.mu.Lock()
+	if pc.dead != nil {
+		err := pc.dead
+		pc.mu.Unlock()
+		return nil, 0, err
+	}
+	wireID := m.Id
+	if _, busy := pc.pending[wireID]; busy {
+		for {
+			wireID = pc.nextID
+			pc.nextID++
+			if _, busy := pc.pending[wireID]; !busy {
+				break
+			}
+		}
+	}
+	pc.pending[wireID] = ch
+	pc.used = time.Now()
+	pc.mu.Unlock()
+
+	wire := m
+	if wireID != m.Id {
+		wire = m.copy()
+		wire.Id = wireID
+	}
+
+	writeTimeout := dnsTimeout
+	if c.WriteTimeout != 0 {
+		writeTimeout = c.WriteTimeout
+	}
+	readTimeout := dnsTimeout
+	if c.ReadTimeout != 0 {
+		readTimeout = c.ReadTimeout
+	}
+
+	start := time.Now()
+	pc.wmu.Lock()
+	pc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err := pc.WriteMsg(wire)
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.mu.Lock()
+		delete(pc.pending, wireID)
+		pc.mu.Unlock()
+		pc.abort(err)
+		return nil, 0, err
+	}
+
+	timer := time.NewTimer(readTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		rtt := time.Since(start)
+		if res.err != nil {
+			return nil, rtt, res.err
+		}
+		if wireID != m.Id {
+			res.m.Id = m.Id
+		}
+		pc.mu.Lock()
+		pc.used = time.Now()
+		pc.mu.Unlock()
+		return res.m, rtt, nil
+	case <-timer.C:
+		pc.mu.Lock()
+		delete(pc.pending, wireID)
+		pc.mu.Unlock()
+		return nil, time.Since(start), errPoolReadTimeout
+	}
+}
+
+// conn returns a pooled connection for network/address, pruning dead or
+// idle-timed-out connections first. While the host has a live
+// connection left, one is handed out round-robin and shared by
+// pipelining; a new one is dialed only when none is left, and callers
+// that find the host empty at the same moment each dial their own.
+// pooled reports whether the returned connection is kept in the pool,
+// as opposed to a one-off connection handed out when the MaxConnsPerHost
+// check made before dialing finds no room (it finds room whenever it
+// runs, since the host then holds no connection).
+func (p *Pool) conn(c *Client, network, address string) (pc *poolConn, pooled bool, err error) {
+	p.mu.Lock()
+	if p.hosts == nil {
+		p.hosts = make(map[string]*poolHost)
+	}
+	key := network + " " + address
+	h, ok := p.hosts[key]
+	if !ok {
+		h = new(poolHost)
+		p.hosts[key] = h
+	}
+	p.mu.Unlock()
+
+	idle := p.idleTimeout()
+	h.mu.Lock()
+	live := h.conns[:0]
+	for _, old := range h.conns {
+		switch {
+		case !old.isAlive():
+		case idle > 0 && time.Since(old.lastUsed()) > idle:
+			go old.abort(ErrConnEmpty)
+		default:
+			live = append(live, old)
+		}
+	}
+	if maxIdle := p.maxIdleConns(); len(live) > maxIdle {
+		var busy, spare []*poolConn
+		for _, c := range live {
+			if c.idle() {
+				spare = append(spare, c)
+			} else {
+				busy = append(busy, c)
+			}
+		}
+		if keep := maxIdle - len(busy); keep < len(spare) {
+			if keep < 0 {
+				keep = 0
+			}
+			sort.Slice(spare, func(i, j int) bool { return spare[i].lastUsed().After(spare[j].lastUsed()) })
+			for _, stale := range spare[keep:] {
+				go stale.abort(ErrConnEmpty)
+			}
+			spare = spare[:keep]
+		}
+		live = append(busy, spare...)
+	}
+	h.conns = live
+	if len(h.conns) > 0 {
+		h.next = (h.next + 1) % len(h.conns)
+		pc = h.conns[h.next]
+		h.mu.Unlock()
+		return pc, true, nil
+	}
+	room := len(h.conns) < p.maxConnsPerHost()
+	h.mu.Unlock()
+
+	timeout := dnsTimeout
+	if c.DialTimeout != 0 {
+		timeout = c.DialTimeout
+	}
+	co := new(Conn)
+	co.Conn, err = c.dialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	co.TsigSecret = c.TsigSecret
+	pc = newPoolConn(h, co)
+	if !room {
+		return pc, false, nil
+	}
+	h.mu.Lock()
+	h.conns = append(h.conns, pc)
+	h.mu.Unlock()
+	return pc, true, nil
+}
+
+// errPoolConnDiscarded marks a one-off connection dialed because its
+// host was already at MaxConnsPerHost; it is never added to a poolHost,
+// so it must be torn down explicitly once used instead of relying on
+// idle-timeout pruning to eventually catch it.
+var errPoolConnDiscarded = errors.New("dns: pooled connection discarded after use")
+
+// exchange performs m against a over network on behalf of c, using a
+// connection from the pool. If the connection handed out turns out to
+// be dead, it is dropped and a single retry is made on a freshly dialed
+// connection.
+func (p *Pool) exchange(c *Client, m *Msg, a, network string) (r *Msg, rtt time.Duration, err error) {
+	if network == "" {
+		network = "tcp"
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		var pc *poolConn
+		var pooled bool
+		pc, pooled, err = p.conn(c, network, a)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, rtt, err = pc.exchange(c, m)
+		if !pooled {
+			// Not tracked by any poolHost: close it now or its
+			// readLoop goroutine and socket leak forever.
+			pc.abort(errPoolConnDiscarded)
+			return r, rtt, err
+		}
+		if err == nil || pc.isAlive() {
+			return r, rtt, err
+		}
+	}
+	return r, rtt, err
+}
@@ -0,0 +1,309 @@
+// Copyright 2011 Miek Gieben. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readFramedTCP reads one length-prefixed DNS message off conn.
+func readFramedTCP(conn net.Conn) ([]byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, err
+	}
+	l := int(lenBuf[0])<<8 | int(lenBuf[1])
+	body := make([]byte, l)
+	_, err := io.ReadFull(conn, body)
+	return body, err
+}
+
+// writeFramedTCP writes body as one length-prefixed DNS message.
+func writeFramedTCP(conn net.Conn, body []byte) error {
+	out := make([]byte, 2+len(body))
+	out[0], out[1] = byte(len(body)>>8), byte(len(body))
+	copy(out[2:], body)
+	_, err := conn.Write(out)
+	return err
+}
+
+// TestPoolConnIDCollision drives two concurrent exchanges that
+// deliberately share the same DNS message ID through a single
+// poolConn, and checks that both complete with their own reply intact
+// rather than one stealing the other's channel.
+func TestPoolConnIDCollision(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		frames := make([][]byte, 0, 2)
+		for i := 0; i < 2; i++ {
+			f, err := readFramedTCP(conn)
+			if err != nil {
+				return
+			}
+			frames = append(frames, f)
+		}
+		// Reply in reverse order to prove dispatch doesn't depend on
+		// request order either.
+		for i := len(frames) - 1; i >= 0; i-- {
+			if err := writeFramedTCP(conn, frames[i]); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := &Client{Net: "tcp"}
+	co, err := c.dialConn(ln.Addr().String(), c.Net)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	pc := newPoolConn(new(poolHost), co)
+
+	m1 := new(Msg)
+	m1.SetQuestion(Fqdn("one.example."), TypeA)
+	m1.Id = 42
+	m2 := new(Msg)
+	m2.SetQuestion(Fqdn("two.example."), TypeA)
+	m2.Id = 42 // deliberate collision with m1
+
+	var wg sync.WaitGroup
+	var r1, r2 *Msg
+	var e1, e2 error
+	wg.Add(2)
+	go func() { defer wg.Done(); r1, _, e1 = pc.exchange(c, m1) }()
+	go func() { defer wg.Done(); r2, _, e2 = pc.exchange(c, m2) }()
+
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("colliding queries hung instead of both completing")
+	}
+
+	if e1 != nil {
+		t.Errorf("query 1: %v", e1)
+	}
+	if e2 != nil {
+		t.Errorf("query 2: %v", e2)
+	}
+	if r1 == nil || r2 == nil {
+		t.Fatal("expected both queries to receive a reply")
+	}
+	if len(r1.Question) == 0 || len(r2.Question) == 0 || r1.Question[0].Name == r2.Question[0].Name {
+		t.Fatalf("replies got mixed up: r1=%v r2=%v", r1.Question, r2.Question)
+	}
+}
+
+// TestPoolReusesConnectionAtMaxConnsPerHost checks that with
+// MaxConnsPerHost set to 1, a second exchange to the same host reuses
+// its one pooled connection: afterwards the host still tracks exactly
+// that connection, and it is still alive.
+func TestPoolReusesConnectionAtMaxConnsPerHost(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					f, err := readFramedTCP(conn)
+					if err != nil {
+						return
+					}
+					if writeFramedTCP(conn, f) != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	p := NewPool()
+	p.MaxConnsPerHost = 1
+	c := &Client{Net: "tcp", Pool: p}
+
+	m := new(Msg)
+	m.SetQuestion(Fqdn("first.example."), TypeA)
+	if _, _, err := c.Exchange(m, ln.Addr().String()); err != nil {
+		t.Fatalf("first exchange: %v", err)
+	}
+
+	key := "tcp " + ln.Addr().String()
+	p.mu.Lock()
+	h := p.hosts[key]
+	p.mu.Unlock()
+	if h == nil {
+		t.Fatal("expected a poolHost to have been created")
+	}
+	h.mu.Lock()
+	if len(h.conns) != 1 {
+		h.mu.Unlock()
+		t.Fatalf("expected exactly one pooled connection, got %d", len(h.conns))
+	}
+	pooledConn := h.conns[0]
+	h.mu.Unlock()
+
+	m2 := new(Msg)
+	m2.SetQuestion(Fqdn("second.example."), TypeA)
+	if _, _, err := c.Exchange(m2, ln.Addr().String()); err != nil {
+		t.Fatalf("second exchange: %v", err)
+	}
+
+	h.mu.Lock()
+	got := len(h.conns)
+	stillPooled := got == 1 && h.conns[0] == pooledConn
+	h.mu.Unlock()
+	if !stillPooled {
+		t.Fatalf("expected the second exchange to reuse the pooled connection: %d conns tracked", got)
+	}
+	if !pooledConn.isAlive() {
+		t.Fatal("the original pooled connection should remain alive")
+	}
+}
+
+// TestPoolConnIndependentTimeouts checks that one caller's short
+// ReadTimeout on a pipelined poolConn times out on its own without
+// stomping the shared connection's read deadline out from under a
+// concurrent caller that is still well within its own, longer budget.
+func TestPoolConnIndependentTimeouts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	srvDone := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// The two exchanges race to write, so the wire order of A's and
+		// B's frames isn't guaranteed; identify A's by DNS ID rather
+		// than assuming it arrives first.
+		var fA []byte
+		for i := 0; i < 2; i++ {
+			f, err := readFramedTCP(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			m := new(Msg)
+			if m.Unpack(f) == nil && m.Id == 1 {
+				fA = f
+			}
+		}
+		// Long enough to blow past B's timeout but well inside A's.
+		time.Sleep(150 * time.Millisecond)
+		writeFramedTCP(conn, fA) // only A ever gets an answer
+		srvDone <- conn          // kept open until the test is done asserting
+	}()
+
+	c := &Client{Net: "tcp"}
+	co, err := c.dialConn(ln.Addr().String(), c.Net)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	pc := newPoolConn(new(poolHost), co)
+
+	mA := new(Msg)
+	mA.SetQuestion(Fqdn("slow-but-within-budget.example."), TypeA)
+	mA.Id = 1
+	mB := new(Msg)
+	mB.SetQuestion(Fqdn("impatient.example."), TypeA)
+	mB.Id = 2
+
+	cA := &Client{Net: "tcp", ReadTimeout: 2 * time.Second}
+	cB := &Client{Net: "tcp", ReadTimeout: 50 * time.Millisecond}
+
+	var rA *Msg
+	var eA, eB error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); rA, _, eA = pc.exchange(cA, mA) }()
+	go func() { defer wg.Done(); _, _, eB = pc.exchange(cB, mB) }()
+
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("exchanges did not both complete")
+	}
+
+	if eB == nil {
+		t.Fatal("expected B's short ReadTimeout to time out")
+	}
+	if eA != nil {
+		t.Fatalf("A's own, longer ReadTimeout should not have been affected by B's: %v", eA)
+	}
+	if rA == nil {
+		t.Fatal("expected A to receive its reply")
+	}
+	if !pc.isAlive() {
+		t.Fatal("B's timeout should not have torn down the shared connection")
+	}
+
+	select {
+	case conn := <-srvDone:
+		conn.Close()
+	case <-time.After(time.Second):
+	}
+}
+
+// TestPoolExchangeReadTimeout checks that Client.ReadTimeout bounds a
+// pooled exchange against an unresponsive server, rather than blocking
+// forever behind the one-time dial deadline.
+func TestPoolExchangeReadTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readFramedTCP(conn) // accept the query, never reply
+		time.Sleep(5 * time.Second)
+	}()
+
+	c := &Client{Net: "tcp", Pool: NewPool(), ReadTimeout: 200 * time.Millisecond}
+	m := new(Msg)
+	m.SetQuestion(Fqdn("silence.example."), TypeA)
+
+	start := time.Now()
+	_, _, err = c.Exchange(m, ln.Addr().String())
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("expected a read-timeout error from an unresponsive server")
+	}
+	if elapsed > 2*time.Second {
+		t.Fatalf("exchange took %v, ReadTimeout was not applied to the pooled connection", elapsed)
+	}
+}